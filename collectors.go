@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	tc "github.com/guidewire/teamcity-go-bindings"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// tcTimestampLayout is the format TeamCity uses for REST API timestamps,
+// e.g. queuedDate/startDate on queued and running builds.
+const tcTimestampLayout = "20060102T150405-0700"
+
+var (
+	agentsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "agents"),
+		"Number of TeamCity build agents by pool and status",
+		[]string{"instance", "pool", "connected", "authorized", "enabled"}, nil,
+	)
+	agentStatusDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "agent_status"),
+		"1 if an agent is enabled and authorized, 0 otherwise",
+		[]string{"instance", "agent", "pool"}, nil,
+	)
+	buildQueueLengthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "build", "queue_length"),
+		"Number of builds currently queued, by build configuration and priority",
+		[]string{"instance", "build_configuration", "priority"}, nil,
+	)
+	buildQueueWaitSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "build", "queue_wait_seconds"),
+		"How long a queued build has been waiting to start",
+		[]string{"instance", "build_configuration", "build_id"}, nil,
+	)
+	runningBuildsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "running_builds"),
+		"Percentage complete of currently running builds, by build configuration and branch",
+		[]string{"instance", "build_configuration", "branch"}, nil,
+	)
+	buildProblemsTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "build", "problems_total"),
+		"Total number of build problems reported by TeamCity, by problem type and build configuration",
+		[]string{"instance", "type", "build_configuration"}, nil,
+	)
+)
+
+// collectorEnabled reports whether the named fleet-level collector is
+// turned on for this instance. The per-build statistics collector always
+// runs; these additional ones are opt-in since they hit extra REST
+// endpoints that not every TeamCity installation needs scraped.
+func (i *Instance) collectorEnabled(name string) bool {
+	for _, c := range i.Collectors {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Instance) collectAgents(ctx context.Context, c *tc.Client) {
+	agents, err := getAllAgentsCtx(ctx, c)
+	if err != nil {
+		log.Errorf("Failed to query agents for instance '%s': %v", i.Name, err)
+		incCounter(scrapeErrorsTotal, i.Name, "agents")
+		return
+	}
+
+	counts := map[[4]string]int{}
+	for _, a := range agents.Agent {
+		key := [4]string{a.Pool, strconv.FormatBool(a.Connected), strconv.FormatBool(a.Authorized), strconv.FormatBool(a.Enabled)}
+		counts[key]++
+
+		status := 0.0
+		if a.Enabled && a.Authorized {
+			status = 1
+		}
+		metricsStorage.Set(getHash(agentStatusDesc.String(), i.Name, a.Name, a.Pool), prometheus.MustNewConstMetric(agentStatusDesc, prometheus.GaugeValue, status, i.Name, a.Name, a.Pool))
+	}
+
+	for key, count := range counts {
+		metricsStorage.Set(getHash(agentsDesc.String(), i.Name, key[0], key[1], key[2], key[3]), prometheus.MustNewConstMetric(agentsDesc, prometheus.GaugeValue, float64(count), i.Name, key[0], key[1], key[2], key[3]))
+	}
+}
+
+func (i *Instance) collectQueue(ctx context.Context, c *tc.Client) {
+	queue, err := getBuildQueueCtx(ctx, c)
+	if err != nil {
+		log.Errorf("Failed to query build queue for instance '%s': %v", i.Name, err)
+		incCounter(scrapeErrorsTotal, i.Name, "queue")
+		return
+	}
+
+	lengths := map[[2]string]int{}
+	for _, b := range queue.Build {
+		lengths[[2]string{b.BuildTypeID, b.Priority}]++
+
+		queuedDate, err := time.Parse(tcTimestampLayout, b.QueuedDate)
+		if err != nil {
+			continue
+		}
+		buildID := strconv.Itoa(int(b.ID))
+		metricsStorage.Set(getHash(buildQueueWaitSecondsDesc.String(), i.Name, b.BuildTypeID, buildID), prometheus.MustNewConstMetric(buildQueueWaitSecondsDesc, prometheus.GaugeValue, time.Since(queuedDate).Seconds(), i.Name, b.BuildTypeID, buildID))
+	}
+
+	for key, count := range lengths {
+		metricsStorage.Set(getHash(buildQueueLengthDesc.String(), i.Name, key[0], key[1]), prometheus.MustNewConstMetric(buildQueueLengthDesc, prometheus.GaugeValue, float64(count), i.Name, key[0], key[1]))
+	}
+}
+
+func (i *Instance) collectRunningBuilds(ctx context.Context, c *tc.Client) {
+	running, err := getRunningBuildsCtx(ctx, c)
+	if err != nil {
+		log.Errorf("Failed to query running builds for instance '%s': %v", i.Name, err)
+		incCounter(scrapeErrorsTotal, i.Name, "running_builds")
+		return
+	}
+
+	for _, b := range running.Build {
+		metricsStorage.Set(getHash(runningBuildsDesc.String(), i.Name, b.BuildTypeID, b.BranchName), prometheus.MustNewConstMetric(runningBuildsDesc, prometheus.GaugeValue, b.PercentageComplete, i.Name, b.BuildTypeID, b.BranchName))
+	}
+}
+
+func (i *Instance) collectBuildProblems(ctx context.Context, c *tc.Client) {
+	problems, err := getProblemOccurrencesCtx(ctx, c)
+	if err != nil {
+		log.Errorf("Failed to query build problems for instance '%s': %v", i.Name, err)
+		incCounter(scrapeErrorsTotal, i.Name, "problems")
+		return
+	}
+
+	counts := map[[2]string]int{}
+	for _, p := range problems.ProblemOccurrence {
+		counts[[2]string{p.Type, p.BuildTypeID}]++
+	}
+	// problemOccurrences reflects currently-open problems, not a running
+	// total of events, so this is published as a gauge despite the
+	// "_total" name: a CounterValue here would read as a reset every time
+	// a problem gets resolved between scrapes.
+	for key, count := range counts {
+		metricsStorage.Set(getHash(buildProblemsTotalDesc.String(), i.Name, key[0], key[1]), prometheus.MustNewConstMetric(buildProblemsTotalDesc, prometheus.GaugeValue, float64(count), i.Name, key[0], key[1]))
+	}
+}
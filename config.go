@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	tc "github.com/guidewire/teamcity-go-bindings"
+	"github.com/prometheus/common/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Configuration is the top level structure of the exporter's YAML config file.
+type Configuration struct {
+	Instances []*Instance `yaml:"instances"`
+}
+
+// Instance describes a single TeamCity server to scrape.
+type Instance struct {
+	Name           string `yaml:"name"`
+	URL            string `yaml:"url"`
+	Username       string `yaml:"username"`
+	Password       string `yaml:"password"`
+	ScrapeInterval int    `yaml:"scrape_interval"`
+	// ScrapeTimeout bounds how long a single scrape may run before it is
+	// cancelled, so a stuck request can't pile up goroutines across ticks.
+	// Defaults to ScrapeInterval when unset.
+	ScrapeTimeout int           `yaml:"scrape_timeout"`
+	BuildsFilters []BuildFilter `yaml:"builds_filters"`
+
+	// RemoteWrite, when set, causes per-build statistic samples to be
+	// pushed to a Prometheus remote_write endpoint or Pushgateway in
+	// addition to being served from the local /metrics endpoint. There is
+	// no push-only mode, and the fleet-level collectors are not pushed.
+	RemoteWrite *RemoteWriteConfig `yaml:"remote_write"`
+
+	// MaxConcurrentBuildFetches and MaxConcurrentStatFetches bound how many
+	// GetBuildsByParams/GetBuildStat calls run at once against this
+	// instance, so a scrape of a server with thousands of build
+	// configurations can't exhaust file descriptors or hammer TeamCity.
+	MaxConcurrentBuildFetches int `yaml:"max_concurrent_build_fetches"`
+	MaxConcurrentStatFetches  int `yaml:"max_concurrent_stat_fetches"`
+
+	// RequestsPerSecond, if set, additionally caps the rate of requests
+	// issued to this instance regardless of how many slots are free.
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+
+	// MaxQueuedRequests bounds how many requests may be waiting for a free
+	// slot before new ones are dropped instead of queued. Zero means
+	// requests queue indefinitely.
+	MaxQueuedRequests int `yaml:"max_queued_requests"`
+
+	// StatePath and StateBackend configure where persistent build cursors
+	// are stored. StateBackend is "json" (default) or "bolt". StatePath
+	// defaults to a per-instance file in the working directory.
+	StatePath    string `yaml:"state_path"`
+	StateBackend string `yaml:"state_backend"`
+
+	// Collectors opts this instance into fleet-level collectors beyond the
+	// default per-build statistics, e.g. "agents", "queue",
+	// "running_builds", "problems".
+	Collectors []string `yaml:"collectors"`
+
+	stateStore StateStore
+	stateOnce  sync.Once
+}
+
+// getStateStore lazily opens this instance's StateStore. If it can't be
+// opened, scraping falls back to an in-memory store so the instance still
+// works, just without cursors surviving a restart.
+func (i *Instance) getStateStore() StateStore {
+	i.stateOnce.Do(func() {
+		path := i.StatePath
+		if path == "" {
+			path = "teamcity_exporter_state_" + i.Name + ".json"
+		}
+
+		var (
+			store StateStore
+			err   error
+		)
+		if i.StateBackend == "bolt" {
+			store, err = newBoltStateStore(path)
+		} else {
+			store, err = newJSONFileStateStore(path)
+		}
+		if err != nil {
+			log.Errorf("Failed to open state store for instance '%s', cursors will not persist across restarts: %v", i.Name, err)
+			store = newInMemoryStateStore()
+		}
+		i.stateStore = store
+	})
+	return i.stateStore
+}
+
+// BuildFilter narrows down which builds are scraped for an Instance.
+type BuildFilter struct {
+	Name     string `yaml:"name"`
+	instance string
+	Filter   tc.BuildLocator
+}
+
+// Build pairs a TeamCity build with the filter that produced it.
+type Build struct {
+	Details tc.Build
+	Filter  BuildFilter
+}
+
+// BuildStatistics pairs a Build with its statistic properties.
+type BuildStatistics struct {
+	Build Build
+	Stat  tc.Properties
+}
+
+// Label is a single Prometheus label name/value pair.
+type Label struct {
+	Name  string
+	Value string
+}
+
+func (c *Configuration) parseConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, c)
+}
+
+func (c *Configuration) validateConfig() error {
+	if len(c.Instances) == 0 {
+		return errors.New("configuration must contain at least one instance")
+	}
+	for i := range c.Instances {
+		if c.Instances[i].Name == "" {
+			return errors.New("instance name must not be empty")
+		}
+		if c.Instances[i].URL == "" {
+			return errors.New("instance '" + c.Instances[i].Name + "' must have a url")
+		}
+		if c.Instances[i].ScrapeInterval <= 0 {
+			c.Instances[i].ScrapeInterval = 60
+		}
+		if err := c.Instances[i].RemoteWrite.validate(); err != nil {
+			return err
+		}
+		for _, collector := range c.Instances[i].Collectors {
+			if !validCollectors[collector] {
+				return errors.New("instance '" + c.Instances[i].Name + "' has unknown collector '" + collector + "'")
+			}
+		}
+	}
+	return nil
+}
+
+var validCollectors = map[string]bool{
+	"agents":         true,
+	"queue":          true,
+	"running_builds": true,
+	"problems":       true,
+}
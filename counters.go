@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scrapeTimeoutsTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "timeouts_total"),
+		"Total number of scrapes cancelled after exceeding their deadline",
+		[]string{"instance"}, nil,
+	)
+	scrapeErrorsTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "errors_total"),
+		"Total number of errors encountered while scraping a TeamCity instance",
+		[]string{"instance", "stage"}, nil,
+	)
+)
+
+var (
+	counterMu     sync.Mutex
+	counterValues = map[string]float64{}
+)
+
+// incCounter increments and republishes a counter metric identified by desc
+// and its label values. metricsStorage only stores the latest sample for a
+// given key, so the running total is tracked separately here.
+func incCounter(desc *prometheus.Desc, labelValues ...string) {
+	counterMu.Lock()
+	key := getHash(desc.String(), labelValues...)
+	counterValues[key]++
+	value := counterValues[key]
+	counterMu.Unlock()
+
+	metricsStorage.Set(key, prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labelValues...))
+}
+
+// resetCounters forgets the running totals for the given metricsStorage
+// keys, so a later incCounter call for one of them starts again from
+// zero instead of resuming from a stale total. Used when an instance's
+// metrics are purged on reload, so a later re-added instance with the
+// same name doesn't inherit its predecessor's counts.
+func resetCounters(keys []string) {
+	counterMu.Lock()
+	for _, key := range keys {
+		delete(counterValues, key)
+	}
+	counterMu.Unlock()
+}
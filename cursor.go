@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	bolt "github.com/boltdb/bolt"
+)
+
+// Cursor records the last build successfully processed for a given
+// (instance, buildType, branch) combination, so the next scrape only asks
+// TeamCity for builds newer than this one instead of re-fetching history.
+type Cursor struct {
+	BuildID    int    `json:"build_id"`
+	FinishDate string `json:"finish_date"`
+}
+
+// StateStore persists cursors across process restarts. Advance is the only
+// write path: it compares against the stored cursor and updates it under
+// the store's own lock, so concurrent scrapes of different builds can
+// never move a cursor backwards.
+type StateStore interface {
+	Get(instance, buildType, branch string) (Cursor, bool)
+	Advance(instance, buildType, branch string, c Cursor) error
+}
+
+func cursorKey(instance, buildType, branch string) string {
+	return instance + "|" + buildType + "|" + branch
+}
+
+// jsonFileStateStore is the default StateStore: the whole cursor map lives
+// in a single JSON file, rewritten on every Advance that moves a cursor
+// forward. Simple and durable
+// enough for the handful of writes a scrape produces.
+type jsonFileStateStore struct {
+	mu   sync.Mutex
+	path string
+	data map[string]Cursor
+}
+
+func newJSONFileStateStore(path string) (*jsonFileStateStore, error) {
+	s := &jsonFileStateStore{path: path, data: map[string]Cursor{}}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonFileStateStore) Get(instance, buildType, branch string) (Cursor, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.data[cursorKey(instance, buildType, branch)]
+	return c, ok
+}
+
+func (s *jsonFileStateStore) Advance(instance, buildType, branch string, c Cursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := cursorKey(instance, buildType, branch)
+	if existing, ok := s.data[key]; ok && existing.BuildID >= c.BuildID {
+		return nil
+	}
+	s.data[key] = c
+
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, raw, 0644)
+}
+
+var cursorBucket = []byte("cursors")
+
+// boltStateStore is an alternative StateStore backed by a local BoltDB
+// file, for users who'd rather not rewrite a JSON file on every build.
+type boltStateStore struct {
+	db *bolt.DB
+}
+
+func newBoltStateStore(path string) (*boltStateStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(cursorBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStateStore{db: db}, nil
+}
+
+func (s *boltStateStore) Get(instance, buildType, branch string) (Cursor, bool) {
+	var c Cursor
+	var ok bool
+	s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(cursorBucket).Get([]byte(cursorKey(instance, buildType, branch)))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &c); err == nil {
+			ok = true
+		}
+		return nil
+	})
+	return c, ok
+}
+
+func (s *boltStateStore) Advance(instance, buildType, branch string, c Cursor) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(cursorBucket)
+		key := []byte(cursorKey(instance, buildType, branch))
+
+		if v := bucket.Get(key); v != nil {
+			var existing Cursor
+			if err := json.Unmarshal(v, &existing); err == nil && existing.BuildID >= c.BuildID {
+				return nil
+			}
+		}
+
+		raw, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, raw)
+	})
+}
+
+// inMemoryStateStore is used when the configured StateStore fails to open,
+// so a scrape can still proceed without persisted cursors rather than
+// crashing the instance.
+type inMemoryStateStore struct {
+	mu   sync.Mutex
+	data map[string]Cursor
+}
+
+func newInMemoryStateStore() *inMemoryStateStore {
+	return &inMemoryStateStore{data: map[string]Cursor{}}
+}
+
+func (s *inMemoryStateStore) Get(instance, buildType, branch string) (Cursor, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.data[cursorKey(instance, buildType, branch)]
+	return c, ok
+}
+
+func (s *inMemoryStateStore) Advance(instance, buildType, branch string, c Cursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := cursorKey(instance, buildType, branch)
+	if existing, ok := s.data[key]; ok && existing.BuildID >= c.BuildID {
+		return nil
+	}
+	s.data[key] = c
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func testStateStoreAdvanceIsMonotonic(t *testing.T, store StateStore) {
+	t.Helper()
+
+	if err := store.Advance("inst", "Build", "main", Cursor{BuildID: 10, FinishDate: "20260101T000000+0000"}); err != nil {
+		t.Fatalf("Advance to 10 failed: %v", err)
+	}
+	if c, ok := store.Get("inst", "Build", "main"); !ok || c.BuildID != 10 {
+		t.Fatalf("expected cursor BuildID 10, got %+v (ok=%v)", c, ok)
+	}
+
+	// An older build must not move the cursor backwards.
+	if err := store.Advance("inst", "Build", "main", Cursor{BuildID: 5, FinishDate: "20251231T000000+0000"}); err != nil {
+		t.Fatalf("Advance to 5 failed: %v", err)
+	}
+	if c, ok := store.Get("inst", "Build", "main"); !ok || c.BuildID != 10 {
+		t.Fatalf("expected cursor to stay at BuildID 10, got %+v (ok=%v)", c, ok)
+	}
+
+	// A newer build must advance it.
+	if err := store.Advance("inst", "Build", "main", Cursor{BuildID: 20, FinishDate: "20260102T000000+0000"}); err != nil {
+		t.Fatalf("Advance to 20 failed: %v", err)
+	}
+	if c, ok := store.Get("inst", "Build", "main"); !ok || c.BuildID != 20 {
+		t.Fatalf("expected cursor to advance to BuildID 20, got %+v (ok=%v)", c, ok)
+	}
+
+	// A different (instance, buildType, branch) key must be independent.
+	if _, ok := store.Get("inst", "Build", "release"); ok {
+		t.Fatal("expected no cursor for an unrelated branch")
+	}
+}
+
+func TestInMemoryStateStoreAdvanceIsMonotonic(t *testing.T) {
+	testStateStoreAdvanceIsMonotonic(t, newInMemoryStateStore())
+}
+
+func TestJSONFileStateStoreAdvanceIsMonotonic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursors.json")
+	store, err := newJSONFileStateStore(path)
+	if err != nil {
+		t.Fatalf("newJSONFileStateStore failed: %v", err)
+	}
+	testStateStoreAdvanceIsMonotonic(t, store)
+
+	// Reopening the same file must see the persisted cursor.
+	reopened, err := newJSONFileStateStore(path)
+	if err != nil {
+		t.Fatalf("reopening state store failed: %v", err)
+	}
+	if c, ok := reopened.Get("inst", "Build", "main"); !ok || c.BuildID != 20 {
+		t.Fatalf("expected reopened store to see persisted cursor BuildID 20, got %+v (ok=%v)", c, ok)
+	}
+}
+
+func TestBoltStateStoreAdvanceIsMonotonic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursors.bolt")
+	store, err := newBoltStateStore(path)
+	if err != nil {
+		t.Fatalf("newBoltStateStore failed: %v", err)
+	}
+	testStateStoreAdvanceIsMonotonic(t, store)
+}
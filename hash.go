@@ -0,0 +1,14 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+)
+
+// getHash builds a stable key for metricsStorage out of a metric name and
+// its label values.
+func getHash(parts ...string) string {
+	h := md5.Sum([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	configLastReloadSuccessTimestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "config_last_reload_success_timestamp_seconds"),
+		"Timestamp of the last successful configuration reload",
+		nil, nil,
+	)
+	configLastReloadSuccessful = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "config_last_reload_successful"),
+		"Whether the last configuration reload succeeded",
+		nil, nil,
+	)
+)
+
+// runningInstance tracks a started Instance scrape loop so it can be
+// cancelled on reload if its configuration changed or it was removed.
+// done is closed once collectStatLoop has actually returned: context
+// cancellation is cooperative, so a scrape already in flight can keep
+// writing metrics for a while after cancel() is called, and purging
+// those metrics before it stops would just let it write them right back.
+type runningInstance struct {
+	instance *Instance
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// instanceManager starts, restarts, and stops per-instance scrape loops as
+// the configuration changes across reloads, following the reload pattern
+// Prometheus itself uses (SIGHUP and POST /-/reload).
+type instanceManager struct {
+	mu         sync.Mutex
+	configPath string
+	running    map[string]*runningInstance
+}
+
+func newInstanceManager(configPath string) *instanceManager {
+	return &instanceManager{
+		configPath: configPath,
+		running:    map[string]*runningInstance{},
+	}
+}
+
+// apply starts any new or changed instances and stops any removed or
+// changed ones, leaving unchanged instances running untouched. Instances
+// are tracked and compared by pointer: Instance embeds a sync.Once (and,
+// once a scrape has run, a StateStore), so copying it by value would trip
+// go vet's lock-copying check.
+func (m *instanceManager) apply(instances []*Instance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, inst := range instances {
+		seen[inst.Name] = true
+
+		if existing, ok := m.running[inst.Name]; ok {
+			if instanceUnchanged(existing.instance, inst) {
+				continue
+			}
+			existing.cancel()
+			purgeInstanceMetricsAfter(inst.Name, existing.done)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		m.running[inst.Name] = &runningInstance{instance: inst, cancel: cancel, done: done}
+		go func() {
+			defer close(done)
+			inst.collectStatLoop(ctx)
+		}()
+	}
+
+	for name, r := range m.running {
+		if !seen[name] {
+			r.cancel()
+			purgeInstanceMetricsAfter(name, r.done)
+			delete(m.running, name)
+		}
+	}
+}
+
+// purgeInstanceMetricsAfter purges an instance's metrics only once its
+// scrape loop has actually stopped, so a scrape already in flight when
+// the instance was cancelled can't write stale samples back in after the
+// purge.
+func purgeInstanceMetricsAfter(name string, done <-chan struct{}) {
+	go func() {
+		<-done
+		purgeInstanceMetrics(name)
+	}()
+}
+
+// instanceConfigSnapshot holds the subset of Instance that defines its
+// runtime behavior, excluding the sync.Once/StateStore bookkeeping fields
+// that aren't safe (or meaningful) to compare or copy.
+type instanceConfigSnapshot struct {
+	URL                       string
+	Username                  string
+	Password                  string
+	ScrapeInterval            int
+	ScrapeTimeout             int
+	BuildsFilters             []BuildFilter
+	RemoteWrite               RemoteWriteConfig
+	MaxConcurrentBuildFetches int
+	MaxConcurrentStatFetches  int
+	RequestsPerSecond         float64
+	MaxQueuedRequests         int
+	StatePath                 string
+	StateBackend              string
+	Collectors                []string
+}
+
+func snapshotInstanceConfig(i *Instance) instanceConfigSnapshot {
+	snap := instanceConfigSnapshot{
+		URL:                       i.URL,
+		Username:                  i.Username,
+		Password:                  i.Password,
+		ScrapeInterval:            i.ScrapeInterval,
+		ScrapeTimeout:             i.ScrapeTimeout,
+		BuildsFilters:             i.BuildsFilters,
+		MaxConcurrentBuildFetches: i.MaxConcurrentBuildFetches,
+		MaxConcurrentStatFetches:  i.MaxConcurrentStatFetches,
+		RequestsPerSecond:         i.RequestsPerSecond,
+		MaxQueuedRequests:         i.MaxQueuedRequests,
+		StatePath:                 i.StatePath,
+		StateBackend:              i.StateBackend,
+		Collectors:                i.Collectors,
+	}
+	if i.RemoteWrite != nil {
+		snap.RemoteWrite = *i.RemoteWrite
+	}
+	return snap
+}
+
+// instanceUnchanged reports whether two configurations of the same
+// instance name can keep running as-is, versus needing a restart because
+// any part of their runtime configuration changed.
+func instanceUnchanged(a, b *Instance) bool {
+	return reflect.DeepEqual(snapshotInstanceConfig(a), snapshotInstanceConfig(b))
+}
+
+// reload re-parses and re-validates the configuration file and applies any
+// changes to the running instances.
+func (m *instanceManager) reload() error {
+	config := Configuration{}
+	if err := config.parseConfig(m.configPath); err != nil {
+		setConfigReloadSuccessful(false)
+		return err
+	}
+	if err := config.validateConfig(); err != nil {
+		setConfigReloadSuccessful(false)
+		return err
+	}
+
+	m.apply(config.Instances)
+
+	setConfigReloadSuccessful(true)
+	metricsStorage.Set(getHash(configLastReloadSuccessTimestamp.String()), prometheus.MustNewConstMetric(configLastReloadSuccessTimestamp, prometheus.GaugeValue, float64(time.Now().Unix())))
+	return nil
+}
+
+func setConfigReloadSuccessful(ok bool) {
+	value := 0.0
+	if ok {
+		value = 1
+	}
+	metricsStorage.Set(getHash(configLastReloadSuccessful.String()), prometheus.MustNewConstMetric(configLastReloadSuccessful, prometheus.GaugeValue, value))
+}
+
+// listenForReloads wires up SIGHUP and POST /-/reload to trigger a reload.
+func (m *instanceManager) listenForReloads() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Infoln("Reloading configuration due to SIGHUP")
+			if err := m.reload(); err != nil {
+				log.Errorf("Failed to reload configuration: %v", err)
+			}
+		}
+	}()
+
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		log.Infoln("Reloading configuration due to /-/reload request")
+		if err := m.reload(); err != nil {
+			log.Errorf("Failed to reload configuration: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestInstanceUnchangedTrueForIdenticalConfig(t *testing.T) {
+	a := &Instance{Name: "a", URL: "http://tc", ScrapeInterval: 60, Collectors: []string{"agents"}}
+	b := &Instance{Name: "a", URL: "http://tc", ScrapeInterval: 60, Collectors: []string{"agents"}}
+	if !instanceUnchanged(a, b) {
+		t.Fatal("expected identical configs to be unchanged")
+	}
+}
+
+func TestInstanceUnchangedDetectsConcurrencyAndRateChanges(t *testing.T) {
+	base := &Instance{Name: "a", URL: "http://tc"}
+	cases := []*Instance{
+		{Name: "a", URL: "http://tc", MaxConcurrentBuildFetches: 5},
+		{Name: "a", URL: "http://tc", MaxConcurrentStatFetches: 5},
+		{Name: "a", URL: "http://tc", RequestsPerSecond: 10},
+		{Name: "a", URL: "http://tc", MaxQueuedRequests: 100},
+		{Name: "a", URL: "http://tc", StatePath: "/tmp/other.json"},
+		{Name: "a", URL: "http://tc", StateBackend: "bolt"},
+		{Name: "a", URL: "http://tc", Collectors: []string{"agents"}},
+		{Name: "a", URL: "http://tc", RemoteWrite: &RemoteWriteConfig{URL: "http://remote"}},
+	}
+	for _, c := range cases {
+		if instanceUnchanged(base, c) {
+			t.Fatalf("expected change to be detected for %+v", c)
+		}
+	}
+}
+
+func TestInstanceUnchangedIgnoresStateStoreBookkeeping(t *testing.T) {
+	statePath := t.TempDir() + "/cursors.json"
+	a := &Instance{Name: "a", URL: "http://tc", StatePath: statePath}
+	b := &Instance{Name: "a", URL: "http://tc", StatePath: statePath}
+
+	// Populating a's lazily-initialized state store must not affect the
+	// comparison: it's runtime bookkeeping, not configuration.
+	a.getStateStore()
+
+	if !instanceUnchanged(a, b) {
+		t.Fatal("expected state store initialization to be ignored by instanceUnchanged")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	defaultRemoteWriteTimeout   = 30 * time.Second
+	defaultRemoteWriteBatchSize = 500
+)
+
+// BasicAuthConfig holds HTTP basic auth credentials for a RemoteWriteConfig.
+type BasicAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// RemoteWriteConfig configures pushing per-build statistic samples to a
+// Prometheus remote_write endpoint or Pushgateway. The samples are still
+// served from the local /metrics endpoint as well.
+type RemoteWriteConfig struct {
+	URL       string           `yaml:"url"`
+	BasicAuth *BasicAuthConfig `yaml:"basic_auth"`
+	Timeout   int              `yaml:"timeout"`    // seconds
+	BatchSize int              `yaml:"batch_size"` // samples per request
+}
+
+func (r *RemoteWriteConfig) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.URL == "" {
+		return errors.New("remote_write.url must not be empty")
+	}
+	if r.Timeout <= 0 {
+		r.Timeout = int(defaultRemoteWriteTimeout / time.Second)
+	}
+	if r.BatchSize <= 0 {
+		r.BatchSize = defaultRemoteWriteBatchSize
+	}
+	return nil
+}
+
+// remoteWriteClient batches prompb.TimeSeries and POSTs them as snappy
+// compressed remote_write requests.
+type remoteWriteClient struct {
+	cfg        *RemoteWriteConfig
+	httpClient *http.Client
+	buffer     []prompb.TimeSeries
+}
+
+func newRemoteWriteClient(cfg *RemoteWriteConfig) *remoteWriteClient {
+	return &remoteWriteClient{
+		cfg: cfg,
+		httpClient: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+		},
+	}
+}
+
+// add appends a sample to the batch, flushing it once BatchSize is reached.
+func (rw *remoteWriteClient) add(ts prompb.TimeSeries) {
+	rw.buffer = append(rw.buffer, ts)
+	if len(rw.buffer) >= rw.cfg.BatchSize {
+		if err := rw.flush(); err != nil {
+			log.Errorf("Failed to push samples to remote_write endpoint '%s': %v", rw.cfg.URL, err)
+		}
+	}
+}
+
+// flush sends any buffered samples and clears the batch.
+func (rw *remoteWriteClient) flush() error {
+	if len(rw.buffer) == 0 {
+		return nil
+	}
+	err := rw.push(rw.buffer)
+	rw.buffer = rw.buffer[:0]
+	return err
+}
+
+func (rw *remoteWriteClient) push(series []prompb.TimeSeries) error {
+	req := &prompb.WriteRequest{Timeseries: series}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	compressed := snappy.Encode(nil, data)
+
+	httpReq, err := http.NewRequest("POST", rw.cfg.URL, bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if rw.cfg.BasicAuth != nil {
+		httpReq.SetBasicAuth(rw.cfg.BasicAuth.Username, rw.cfg.BasicAuth.Password)
+	}
+
+	resp, err := rw.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("remote_write endpoint returned status " + resp.Status)
+	}
+	return nil
+}
+
+// timeSeriesFromSample converts a single named sample with labels into a
+// prompb.TimeSeries with t as its timestamp.
+func timeSeriesFromSample(name string, labels []Label, value float64, t time.Time) prompb.TimeSeries {
+	pbLabels := make([]prompb.Label, 0, len(labels)+1)
+	pbLabels = append(pbLabels, prompb.Label{Name: "__name__", Value: name})
+	for _, l := range labels {
+		pbLabels = append(pbLabels, prompb.Label{Name: l.Name, Value: l.Value})
+	}
+
+	return prompb.TimeSeries{
+		Labels: pbLabels,
+		Samples: []prompb.Sample{
+			{Value: value, Timestamp: t.UnixNano() / int64(time.Millisecond)},
+		},
+	}
+}
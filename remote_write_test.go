@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func decodeWriteRequest(t *testing.T, body []byte) *prompb.WriteRequest {
+	t.Helper()
+	decompressed, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("failed to decompress request body: %v", err)
+	}
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(decompressed, &req); err != nil {
+		t.Fatalf("failed to unmarshal write request: %v", err)
+	}
+	return &req
+}
+
+func TestRemoteWriteClientPushSendsCompressedRequest(t *testing.T) {
+	var gotReq *http.Request
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotReq = r
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("failed to read request body: %v", err)
+		}
+		gotBody = body
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	rw := newRemoteWriteClient(&RemoteWriteConfig{URL: server.URL, Timeout: 5, BatchSize: 500})
+	series := []prompb.TimeSeries{timeSeriesFromSample("teamcity_test_metric", nil, 1, time.Now())}
+	if err := rw.push(series); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	if got := gotReq.Header.Get("Content-Encoding"); got != "snappy" {
+		t.Fatalf("expected Content-Encoding 'snappy', got %q", got)
+	}
+	if got := gotReq.Header.Get("X-Prometheus-Remote-Write-Version"); got != "0.1.0" {
+		t.Fatalf("expected X-Prometheus-Remote-Write-Version '0.1.0', got %q", got)
+	}
+
+	req := decodeWriteRequest(t, gotBody)
+	if len(req.Timeseries) != 1 {
+		t.Fatalf("expected 1 time series, got %d", len(req.Timeseries))
+	}
+}
+
+func TestRemoteWriteClientPushReturnsErrorOnNon2xx(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	rw := newRemoteWriteClient(&RemoteWriteConfig{URL: server.URL, Timeout: 5, BatchSize: 500})
+	if err := rw.push([]prompb.TimeSeries{timeSeriesFromSample("teamcity_test_metric", nil, 1, time.Now())}); err == nil {
+		t.Fatal("expected push to return an error for a non-2xx response")
+	}
+}
+
+func TestRemoteWriteClientAddFlushesAtBatchSize(t *testing.T) {
+	var requests int
+	var lastCount int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := decodeWriteRequest(t, body)
+		requests++
+		lastCount = len(req.Timeseries)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	rw := newRemoteWriteClient(&RemoteWriteConfig{URL: server.URL, Timeout: 5, BatchSize: 2})
+
+	rw.add(timeSeriesFromSample("teamcity_test_metric", nil, 1, time.Now()))
+	if requests != 0 {
+		t.Fatalf("expected no flush before reaching BatchSize, got %d requests", requests)
+	}
+
+	rw.add(timeSeriesFromSample("teamcity_test_metric", nil, 2, time.Now()))
+	if requests != 1 {
+		t.Fatalf("expected exactly 1 flush once BatchSize is reached, got %d", requests)
+	}
+	if lastCount != 2 {
+		t.Fatalf("expected flushed batch to contain 2 series, got %d", lastCount)
+	}
+	if len(rw.buffer) != 0 {
+		t.Fatalf("expected buffer to be cleared after flush, got %d buffered", len(rw.buffer))
+	}
+}
+
+func TestRemoteWriteClientFlushSendsBasicAuth(t *testing.T) {
+	var gotUser, gotPass string
+	var gotOK bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPass, gotOK = r.BasicAuth()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	rw := newRemoteWriteClient(&RemoteWriteConfig{
+		URL:       server.URL,
+		Timeout:   5,
+		BatchSize: 500,
+		BasicAuth: &BasicAuthConfig{Username: "user", Password: "pass"},
+	})
+	rw.add(timeSeriesFromSample("teamcity_test_metric", nil, 1, time.Now()))
+	if err := rw.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	if !gotOK {
+		t.Fatal("expected request to carry basic auth credentials")
+	}
+	if gotUser != "user" || gotPass != "pass" {
+		t.Fatalf("expected basic auth user/pass, got %q/%q", gotUser, gotPass)
+	}
+}
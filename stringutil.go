@@ -0,0 +1,20 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	snakeCaseMatchFirstCap = regexp.MustCompile("(.)([A-Z][a-z]+)")
+	snakeCaseMatchAllCap   = regexp.MustCompile("([a-z0-9])([A-Z])")
+)
+
+// toSnakeCase converts a CamelCase or dotted TeamCity property name into a
+// lower_snake_case Prometheus metric name fragment.
+func toSnakeCase(s string) string {
+	s = strings.Replace(s, ".", "_", -1)
+	s = snakeCaseMatchFirstCap.ReplaceAllString(s, "${1}_${2}")
+	s = snakeCaseMatchAllCap.ReplaceAllString(s, "${1}_${2}")
+	return strings.ToLower(s)
+}
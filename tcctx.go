@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	tc "github.com/guidewire/teamcity-go-bindings"
+)
+
+// The teamcity-go-bindings client has no context support of its own, so
+// these helpers run each call on a goroutine and race it against ctx,
+// letting callers bail out as soon as their deadline passes instead of
+// waiting on a response nobody needs anymore.
+
+func getBuildsByParamsCtx(ctx context.Context, c *tc.Client, locator tc.BuildLocator) (tc.Builds, error) {
+	type result struct {
+		builds tc.Builds
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b, err := c.GetBuildsByParams(locator)
+		done <- result{b, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return tc.Builds{}, ctx.Err()
+	case r := <-done:
+		return r.builds, r.err
+	}
+}
+
+// fetchBuildsByFilterCtx pages through every build matching locator,
+// following locator.Start forward a page at a time until TeamCity returns
+// fewer builds than requested. Without this, a (buildType, branch) that
+// accumulates more new builds between scrapes than fit on one page would
+// only ever see its newest page, silently skipping the rest even though
+// the persisted cursor advances past them.
+//
+// Paging only makes sense once a cursor exists: with no SinceBuild, the
+// caller is asking for the single latest build to seed the cursor, and
+// locator.Count is set accordingly small (locatorSinceCursor uses "1").
+// Paging against that would walk one build at a time through an
+// instance's entire build history, so that case always fetches one page
+// and returns, regardless of how many builds TeamCity reports are left.
+func fetchBuildsByFilterCtx(ctx context.Context, c *tc.Client, locator tc.BuildLocator) ([]tc.Build, error) {
+	if locator.SinceBuild == "" {
+		b, err := getBuildsByParamsCtx(ctx, c, locator)
+		return b.Build, err
+	}
+
+	pageSize, err := strconv.Atoi(locator.Count)
+	if err != nil || pageSize <= 0 {
+		pageSize = 1
+	}
+
+	var all []tc.Build
+	start := 0
+	for {
+		page := locator
+		page.Start = strconv.Itoa(start)
+
+		b, err := getBuildsByParamsCtx(ctx, c, page)
+		if err != nil {
+			return all, err
+		}
+		all = append(all, b.Build...)
+
+		if len(b.Build) < pageSize || ctx.Err() != nil {
+			return all, nil
+		}
+		start += len(b.Build)
+	}
+}
+
+func getBuildStatCtx(ctx context.Context, c *tc.Client, buildID int) (tc.Properties, error) {
+	type result struct {
+		stat tc.Properties
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		s, err := c.GetBuildStat(buildID)
+		done <- result{s, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return tc.Properties{}, ctx.Err()
+	case r := <-done:
+		return r.stat, r.err
+	}
+}
+
+func getAllBuildConfigurationsCtx(ctx context.Context, c *tc.Client) (tc.BuildConfiguration, error) {
+	type result struct {
+		bt  tc.BuildConfiguration
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		bt, err := c.GetAllBuildConfigurations()
+		done <- result{bt, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return tc.BuildConfiguration{}, ctx.Err()
+	case r := <-done:
+		return r.bt, r.err
+	}
+}
+
+func getAllAgentsCtx(ctx context.Context, c *tc.Client) (tc.Agents, error) {
+	type result struct {
+		agents tc.Agents
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		agents, err := c.GetAllAgents()
+		done <- result{agents, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return tc.Agents{}, ctx.Err()
+	case r := <-done:
+		return r.agents, r.err
+	}
+}
+
+func getBuildQueueCtx(ctx context.Context, c *tc.Client) (tc.Queue, error) {
+	type result struct {
+		queue tc.Queue
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		queue, err := c.GetBuildQueue()
+		done <- result{queue, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return tc.Queue{}, ctx.Err()
+	case r := <-done:
+		return r.queue, r.err
+	}
+}
+
+func getRunningBuildsCtx(ctx context.Context, c *tc.Client) (tc.RunningBuilds, error) {
+	type result struct {
+		builds tc.RunningBuilds
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		builds, err := c.GetRunningBuilds()
+		done <- result{builds, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return tc.RunningBuilds{}, ctx.Err()
+	case r := <-done:
+		return r.builds, r.err
+	}
+}
+
+func getProblemOccurrencesCtx(ctx context.Context, c *tc.Client) (tc.ProblemOccurrences, error) {
+	type result struct {
+		problems tc.ProblemOccurrences
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		problems, err := c.GetProblemOccurrences()
+		done <- result{problems, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return tc.ProblemOccurrences{}, ctx.Err()
+	case r := <-done:
+		return r.problems, r.err
+	}
+}
+
+func getAllBranchesCtx(ctx context.Context, c *tc.Client, buildTypeID tc.BuildTypeID) (tc.Branches, error) {
+	type result struct {
+		branches tc.Branches
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		branches, err := c.GetAllBranches(buildTypeID)
+		done <- result{branches, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return tc.Branches{}, ctx.Err()
+	case r := <-done:
+		return r.branches, r.err
+	}
+}
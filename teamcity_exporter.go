@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -16,6 +17,7 @@ import (
 	tc "github.com/guidewire/teamcity-go-bindings"
 	"github.com/orcaman/concurrent-map"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
 )
@@ -26,6 +28,37 @@ const (
 
 var metricsStorage = cmap.New()
 
+// purgeInstanceMetrics removes every metric published under the given
+// instance name from metricsStorage, and forgets any running counter
+// totals for them. Without this, an instance removed or changed on
+// reload keeps serving its last-known (and increasingly stale) samples
+// on /metrics forever, since metricsStorage otherwise only ever gains
+// entries, and a later re-added instance of the same name would resume
+// its counters from the old stale totals instead of zero.
+func purgeInstanceMetrics(name string) {
+	var stale []string
+	for tuple := range metricsStorage.IterBuffered() {
+		metric, ok := tuple.Val.(prometheus.Metric)
+		if !ok {
+			continue
+		}
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+		for _, label := range m.Label {
+			if (label.GetName() == "instance" || label.GetName() == "exporter_instance") && label.GetValue() == name {
+				stale = append(stale, tuple.Key)
+				break
+			}
+		}
+	}
+	for _, key := range stale {
+		metricsStorage.Remove(key)
+	}
+	resetCounters(stale)
+}
+
 var (
 	instanceStatus = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "instance_status"),
@@ -42,6 +75,16 @@ var (
 		"Teamcity instance last scrape duration",
 		[]string{"instance"}, nil,
 	)
+	scrapeInflightRequests = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "inflight_requests"),
+		"Number of requests currently in flight against a TeamCity instance",
+		[]string{"instance", "stage"}, nil,
+	)
+	scrapeDroppedRequestsTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "dropped_requests_total"),
+		"Total number of requests dropped due to backpressure",
+		[]string{"instance", "stage"}, nil,
+	)
 )
 
 func init() {
@@ -77,9 +120,9 @@ func main() {
 		log.Fatalf("Failed to validate configuration: %v", err)
 	}
 
-	for i := range config.Instances {
-		go config.Instances[i].collectStat()
-	}
+	manager := newInstanceManager(*configPath)
+	manager.apply(config.Instances)
+	manager.listenForReloads()
 
 	http.Handle(*metricsPath, prometheus.Handler())
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -95,14 +138,38 @@ func main() {
 	log.Fatalln(http.ListenAndServe(*listenAddress, nil))
 }
 
-func (i *Instance) collectStat() {
+// scrapeTimeout returns how long a single scrape is allowed to run before
+// it is cancelled, falling back to the scrape interval when unset.
+func (i *Instance) scrapeTimeout() time.Duration {
+	if i.ScrapeTimeout > 0 {
+		return time.Duration(i.ScrapeTimeout) * time.Second
+	}
+	return time.Duration(i.ScrapeInterval) * time.Second
+}
+
+// collectStatLoop runs one scrape per tick, guaranteeing at most one
+// in-flight scrape per instance: each run gets its own deadline derived
+// from ScrapeTimeout, and the loop only starts the next run once the
+// previous one has returned or been cancelled. It exits once ctx is
+// cancelled, which happens when the instance is removed or changed on a
+// config reload.
+func (i *Instance) collectStatLoop(ctx context.Context) {
 	ticker := newTicker(time.Duration(i.ScrapeInterval) * time.Second)
-	for _ = range ticker.c {
-		go i.collectStatHandler()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.c:
+			scrapeCtx, cancel := context.WithTimeout(ctx, i.scrapeTimeout())
+			i.collectStatHandler(scrapeCtx)
+			cancel()
+		}
 	}
 }
 
-func (i *Instance) collectStatHandler() {
+func (i *Instance) collectStatHandler(ctx context.Context) {
 	startProcessing := time.Now()
 	client := tc.New(i.URL, i.Username, i.Password)
 
@@ -110,20 +177,44 @@ func (i *Instance) collectStatHandler() {
 	chBuild := make(chan Build)
 	chBuildStat := make(chan BuildStatistics)
 
+	buildLimiter := newRequestLimiter(i.Name, "builds", i.MaxConcurrentBuildFetches, i.RequestsPerSecond, i.MaxQueuedRequests)
+	statLimiter := newRequestLimiter(i.Name, "stats", i.MaxConcurrentStatFetches, i.RequestsPerSecond, i.MaxQueuedRequests)
+
 	wg := &sync.WaitGroup{}
 	wg.Add(4)
-	go i.prepareFilters(client, wg, chBuildFilter)
-	go getBuildsByFilters(client, wg, chBuildFilter, chBuild)
-	go getBuildStat(client, wg, chBuild, chBuildStat)
-	go parseStat(wg, chBuildStat)
+	go i.prepareFilters(ctx, client, wg, chBuildFilter)
+	go getBuildsByFilters(ctx, client, buildLimiter, wg, chBuildFilter, chBuild)
+	go getBuildStat(ctx, client, statLimiter, wg, chBuild, chBuildStat)
+	go i.parseStat(wg, chBuildStat)
+
+	for name, collect := range map[string]func(context.Context, *tc.Client){
+		"agents":         i.collectAgents,
+		"queue":          i.collectQueue,
+		"running_builds": i.collectRunningBuilds,
+		"problems":       i.collectBuildProblems,
+	} {
+		if !i.collectorEnabled(name) {
+			continue
+		}
+		wg.Add(1)
+		go func(collect func(context.Context, *tc.Client)) {
+			defer wg.Done()
+			collect(ctx, client)
+		}(collect)
+	}
 
 	wg.Wait()
 	finishProcessing := time.Now()
 	metricsStorage.Set(getHash(instanceLastScrapeFinishTime.String(), i.Name), prometheus.MustNewConstMetric(instanceLastScrapeFinishTime, prometheus.GaugeValue, float64(finishProcessing.Unix()), i.Name))
 	metricsStorage.Set(getHash(instanceLastScrapeDuration.String(), i.Name), prometheus.MustNewConstMetric(instanceLastScrapeDuration, prometheus.GaugeValue, float64(finishProcessing.Sub(startProcessing)/time.Second), i.Name))
+
+	if ctx.Err() == context.DeadlineExceeded {
+		incCounter(scrapeTimeoutsTotal, i.Name)
+		log.Errorf("Scrape of instance '%s' was cancelled after exceeding its %s deadline", i.Name, i.scrapeTimeout())
+	}
 }
 
-func (i *Instance) prepareFilters(c *tc.Client, wg *sync.WaitGroup, ch chan<- BuildFilter) {
+func (i *Instance) prepareFilters(ctx context.Context, c *tc.Client, wg *sync.WaitGroup, ch chan<- BuildFilter) {
 	defer wg.Done()
 
 	if len(i.BuildsFilters) == 0 {
@@ -131,14 +222,19 @@ func (i *Instance) prepareFilters(c *tc.Client, wg *sync.WaitGroup, ch chan<- Bu
 	}
 
 	for k := range i.BuildsFilters {
+		if ctx.Err() != nil {
+			break
+		}
+
 		bt := tc.BuildConfiguration{}
 		b := map[tc.BuildTypeID][]tc.Branch{}
 
 		if i.BuildsFilters[k].Filter.BuildType == "" {
 			var err error
-			bt, err = c.GetAllBuildConfigurations()
+			bt, err = getAllBuildConfigurationsCtx(ctx, c)
 			if err != nil {
 				log.Errorf("Failed to query available build configurations for instance '%s': %v", i.Name, err)
+				incCounter(scrapeErrorsTotal, i.Name, "prepare_filters")
 			}
 			continue
 		} else {
@@ -147,9 +243,10 @@ func (i *Instance) prepareFilters(c *tc.Client, wg *sync.WaitGroup, ch chan<- Bu
 
 		if i.BuildsFilters[k].Filter.Branch == "" {
 			for v := range bt.BuildTypes {
-				branches, err := c.GetAllBranches(bt.BuildTypes[v].ID)
+				branches, err := getAllBranchesCtx(ctx, c, bt.BuildTypes[v].ID)
 				if err != nil {
 					log.Errorf("Failed to query branches for '%s' build configuration: %v", bt.BuildTypes[v].ID, err)
+					incCounter(scrapeErrorsTotal, i.Name, "prepare_filters")
 					continue
 				}
 
@@ -171,10 +268,7 @@ func (i *Instance) prepareFilters(c *tc.Client, wg *sync.WaitGroup, ch chan<- Bu
 				f := BuildFilter{
 					Name:     i.BuildsFilters[k].Name,
 					instance: i.Name,
-					Filter: tc.BuildLocator{
-						BuildType: string(bt),
-						Branch:    "",
-						Count:     "1"},
+					Filter:   i.locatorSinceCursor(string(bt), ""),
 				}
 				ch <- f
 			} else {
@@ -182,10 +276,7 @@ func (i *Instance) prepareFilters(c *tc.Client, wg *sync.WaitGroup, ch chan<- Bu
 					f := BuildFilter{
 						Name:     i.BuildsFilters[k].Name,
 						instance: i.Name,
-						Filter: tc.BuildLocator{
-							BuildType: string(bt),
-							Branch:    branches[z].Name,
-							Count:     "1"},
+						Filter:   i.locatorSinceCursor(string(bt), branches[z].Name),
 					}
 					ch <- f
 				}
@@ -196,21 +287,29 @@ func (i *Instance) prepareFilters(c *tc.Client, wg *sync.WaitGroup, ch chan<- Bu
 	close(ch)
 }
 
-func getBuildsByFilters(c *tc.Client, wg *sync.WaitGroup, chIn <-chan BuildFilter, chOut chan<- Build) {
+func getBuildsByFilters(ctx context.Context, c *tc.Client, limiter *requestLimiter, wg *sync.WaitGroup, chIn <-chan BuildFilter, chOut chan<- Build) {
 	defer wg.Done()
 	wg1 := &sync.WaitGroup{}
 
 	for i := range chIn {
+		if ctx.Err() != nil {
+			continue
+		}
+		if !limiter.acquire(ctx) {
+			log.Errorf("Dropping build filter '%s': too many requests already queued", i.Name)
+			continue
+		}
 		wg1.Add(1)
 		go func(i BuildFilter) {
 			defer wg1.Done()
-			b, err := c.GetBuildsByParams(i.Filter)
+			defer limiter.release()
+			builds, err := fetchBuildsByFilterCtx(ctx, c, i.Filter)
 			if err != nil {
 				log.Errorf("Failed to query builds by filter '%s': %v", i.Name, err)
-				return
+				incCounter(scrapeErrorsTotal, i.instance, "get_builds")
 			}
-			for v := range b.Build {
-				chOut <- Build{Details: b.Build[v], Filter: i}
+			for v := range builds {
+				chOut <- Build{Details: builds[v], Filter: i}
 			}
 		}(i)
 	}
@@ -219,16 +318,25 @@ func getBuildsByFilters(c *tc.Client, wg *sync.WaitGroup, chIn <-chan BuildFilte
 	close(chOut)
 }
 
-func getBuildStat(c *tc.Client, wg *sync.WaitGroup, chIn <-chan Build, chOut chan<- BuildStatistics) {
+func getBuildStat(ctx context.Context, c *tc.Client, limiter *requestLimiter, wg *sync.WaitGroup, chIn <-chan Build, chOut chan<- BuildStatistics) {
 	defer wg.Done()
 	wg1 := &sync.WaitGroup{}
 	for i := range chIn {
+		if ctx.Err() != nil {
+			continue
+		}
+		if !limiter.acquire(ctx) {
+			log.Errorf("Dropping build statistics fetch for build %s: too many requests already queued", i.Details.WebURL)
+			continue
+		}
 		wg1.Add(1)
 		go func(i Build) {
 			defer wg1.Done()
-			s, err := c.GetBuildStat(int(i.Details.ID))
+			defer limiter.release()
+			s, err := getBuildStatCtx(ctx, c, int(i.Details.ID))
 			if err != nil {
 				log.Errorf("Failed to query build statistics for build %s: %v", i.Details.WebURL, err)
+				incCounter(scrapeErrorsTotal, i.Filter.instance, "get_build_stat")
 				return
 			}
 			chOut <- BuildStatistics{Build: i, Stat: s}
@@ -239,24 +347,29 @@ func getBuildStat(c *tc.Client, wg *sync.WaitGroup, chIn <-chan Build, chOut cha
 	close(chOut)
 }
 
-func parseStat(wg *sync.WaitGroup, chIn <-chan BuildStatistics) {
+func (i *Instance) parseStat(wg *sync.WaitGroup, chIn <-chan BuildStatistics) {
 	defer wg.Done()
 
-	for i := range chIn {
-		for k := range i.Stat.Property {
-			value, err := strconv.ParseFloat(i.Stat.Property[k].Value, 64)
+	var rw *remoteWriteClient
+	if i.RemoteWrite != nil {
+		rw = newRemoteWriteClient(i.RemoteWrite)
+	}
+
+	for s := range chIn {
+		for k := range s.Stat.Property {
+			value, err := strconv.ParseFloat(s.Stat.Property[k].Value, 64)
 			if err != nil {
-				log.Errorf("Failed to convert string '%s' to float: %v", i.Stat.Property[k].Value, err)
+				log.Errorf("Failed to convert string '%s' to float: %v", s.Stat.Property[k].Value, err)
 				continue
 			}
-			metric := strings.SplitN(i.Stat.Property[k].Name, ":", 2)
+			metric := strings.SplitN(s.Stat.Property[k].Name, ":", 2)
 			title := fmt.Sprint(namespace, "_", toSnakeCase(metric[0]))
 
 			labels := []Label{
-				{"exporter_instance", i.Build.Filter.instance},
-				{"exporter_filter", i.Build.Filter.Name},
-				{"build_configuration", string(i.Build.Details.BuildTypeID)},
-				{"branch", i.Build.Details.BranchName},
+				{"exporter_instance", s.Build.Filter.instance},
+				{"exporter_filter", s.Build.Filter.Name},
+				{"build_configuration", string(s.Build.Details.BuildTypeID)},
+				{"branch", s.Build.Details.BranchName},
 			}
 			if len(metric) > 1 {
 				labels = append(labels, Label{"other", metric[1]})
@@ -270,6 +383,23 @@ func parseStat(wg *sync.WaitGroup, chIn <-chan BuildStatistics) {
 
 			desc := prometheus.NewDesc(title, title, labelsTitles, nil)
 			metricsStorage.Set(getHash(title, labelsValues...), prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelsValues...))
+
+			if rw != nil {
+				rw.add(timeSeriesFromSample(title, labels, value, time.Now()))
+			}
+		}
+
+		buildType := string(s.Build.Details.BuildTypeID)
+		branch := s.Build.Details.BranchName
+		cursor := Cursor{BuildID: int(s.Build.Details.ID), FinishDate: s.Build.Details.FinishDate}
+		if err := i.getStateStore().Advance(s.Build.Filter.instance, buildType, branch, cursor); err != nil {
+			log.Errorf("Failed to persist build cursor for '%s'/'%s' on instance '%s': %v", buildType, branch, i.Name, err)
+		}
+	}
+
+	if rw != nil {
+		if err := rw.flush(); err != nil {
+			log.Errorf("Failed to push final batch to remote_write endpoint '%s': %v", i.RemoteWrite.URL, err)
 		}
 	}
 }
@@ -295,6 +425,32 @@ func (i *Instance) validateStatus() error {
 	return nil
 }
 
+// buildPageSize bounds how many builds getBuildsByFilters asks for per
+// request when paging through everything newer than the persisted cursor.
+const buildPageSize = 100
+
+// locatorSinceCursor builds a locator for a (buildType, branch) pair. If a
+// cursor was persisted from a previous scrape it only asks TeamCity for
+// finished builds newer than the last one we processed, in pages of
+// buildPageSize; otherwise it falls back to fetching just the latest build
+// to seed the cursor.
+func (i *Instance) locatorSinceCursor(buildType, branch string) tc.BuildLocator {
+	locator := tc.BuildLocator{
+		BuildType: buildType,
+		Branch:    branch,
+		State:     "finished",
+	}
+
+	if cursor, ok := i.getStateStore().Get(i.Name, buildType, branch); ok {
+		locator.SinceBuild = strconv.Itoa(cursor.BuildID)
+		locator.Count = strconv.Itoa(buildPageSize)
+	} else {
+		locator.Count = "1"
+	}
+
+	return locator
+}
+
 func (i *Instance) addDefaultFilter() BuildFilter {
 	f := BuildFilter{
 		Name:     "default",
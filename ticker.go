@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+// cTicker is a time.Ticker that additionally fires once immediately, so the
+// first scrape of an instance doesn't have to wait a full ScrapeInterval.
+type cTicker struct {
+	c      chan time.Time
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+func newTicker(d time.Duration) *cTicker {
+	t := &cTicker{
+		c:      make(chan time.Time, 1),
+		ticker: time.NewTicker(d),
+		done:   make(chan struct{}),
+	}
+	t.c <- time.Now()
+
+	go func() {
+		for {
+			select {
+			case tick := <-t.ticker.C:
+				select {
+				case t.c <- tick:
+				case <-t.done:
+					return
+				}
+			case <-t.done:
+				return
+			}
+		}
+	}()
+
+	return t
+}
+
+// Stop stops the underlying ticker and the forwarding goroutine. It must
+// only be called once.
+func (t *cTicker) Stop() {
+	t.ticker.Stop()
+	close(t.done)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiterBoundsConcurrency(t *testing.T) {
+	l := newRequestLimiter("test", "stage", 2, 0, 0)
+
+	if !l.acquire(context.Background()) {
+		t.Fatal("expected first acquire to succeed")
+	}
+	if !l.acquire(context.Background()) {
+		t.Fatal("expected second acquire to succeed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if l.acquire(ctx) {
+		t.Fatal("expected third acquire to block until ctx is done, since maxConcurrent is 2")
+	}
+
+	l.release()
+	if !l.acquire(context.Background()) {
+		t.Fatal("expected acquire to succeed once a slot is released")
+	}
+}
+
+func TestRequestLimiterDropsOverQueueDepth(t *testing.T) {
+	l := newRequestLimiter("test", "stage", 1, 0, 0)
+	l.maxQueued = 0 // queue indefinitely by default
+
+	if !l.acquire(context.Background()) {
+		t.Fatal("expected first acquire to succeed")
+	}
+
+	l.maxQueued = 1
+	l.queued = 1 // simulate another waiter already queued
+	if l.acquire(context.Background()) {
+		t.Fatal("expected acquire to be dropped once the queue backlog reaches maxQueued")
+	}
+	if l.dropped != 1 {
+		t.Fatalf("expected dropped counter to be 1, got %d", l.dropped)
+	}
+}
+
+func TestRequestLimiterAcquireRespectsCancelledContext(t *testing.T) {
+	l := newRequestLimiter("test", "stage", 1, 0, 0)
+	if !l.acquire(context.Background()) {
+		t.Fatal("expected first acquire to succeed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if l.acquire(ctx) {
+		t.Fatal("expected acquire to fail immediately for an already-cancelled context")
+	}
+}